@@ -0,0 +1,54 @@
+package options
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/buzzfeed/sso/internal/proxy/providers"
+)
+
+// ProviderConfig holds the realm/client configuration needed to construct
+// the Provider selected by the "provider" option.
+type ProviderConfig struct {
+	// ProviderName selects the Provider implementation, e.g. "keycloak".
+	ProviderName string
+
+	ClientID     string
+	ClientSecret string
+
+	SignInURL  *url.URL
+	SignOutURL *url.URL
+	RedeemURL  *url.URL
+
+	// UserInfoURL is the realm's OIDC userinfo endpoint. Only consulted by
+	// providers that support a userinfo fallback, such as "keycloak".
+	UserInfoURL *url.URL
+
+	// GroupsClaim overrides the default claim name a provider resolves group
+	// membership from, where supported.
+	GroupsClaim string
+}
+
+// NewProvider builds the Provider selected by cfg.ProviderName.
+func NewProvider(cfg ProviderConfig) (providers.Provider, error) {
+	providerData := &providers.ProviderData{
+		ProviderName: cfg.ProviderName,
+		ClientID:     cfg.ClientID,
+		ClientSecret: cfg.ClientSecret,
+		SignInURL:    cfg.SignInURL,
+		SignOutURL:   cfg.SignOutURL,
+		RedeemURL:    cfg.RedeemURL,
+	}
+
+	switch cfg.ProviderName {
+	case "keycloak":
+		p := providers.NewKeycloakProvider(providerData)
+		p.UserInfoURL = cfg.UserInfoURL
+		if cfg.GroupsClaim != "" {
+			p.GroupsClaim = cfg.GroupsClaim
+		}
+		return p, nil
+	default:
+		return nil, fmt.Errorf("options: unknown provider %q", cfg.ProviderName)
+	}
+}
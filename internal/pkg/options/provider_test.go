@@ -0,0 +1,35 @@
+package options
+
+import (
+	"testing"
+
+	"github.com/buzzfeed/sso/internal/proxy/providers"
+)
+
+func TestNewProviderKeycloak(t *testing.T) {
+	p, err := NewProvider(ProviderConfig{
+		ProviderName: "keycloak",
+		ClientID:     "sso-proxy",
+		GroupsClaim:  "roles",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	kc, ok := p.(*providers.KeycloakProvider)
+	if !ok {
+		t.Fatalf("expected a *providers.KeycloakProvider, got %T", p)
+	}
+	if kc.GroupsClaim != "roles" {
+		t.Errorf("expected GroupsClaim to be passed through, got %q", kc.GroupsClaim)
+	}
+	if kc.Data().ClientID != "sso-proxy" {
+		t.Errorf("expected ClientID to be passed through, got %q", kc.Data().ClientID)
+	}
+}
+
+func TestNewProviderUnknown(t *testing.T) {
+	if _, err := NewProvider(ProviderConfig{ProviderName: "not-a-provider"}); err == nil {
+		t.Fatalf("expected an error for an unknown provider name")
+	}
+}
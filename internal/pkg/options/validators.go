@@ -4,7 +4,6 @@ import (
 	"errors"
 
 	"github.com/buzzfeed/sso/internal/pkg/sessions"
-	"github.com/buzzfeed/sso/internal/proxy/providers"
 )
 
 var (
@@ -14,6 +13,16 @@ var (
 	ErrValidationError     = errors.New("Error during validation")
 )
 
+// gracePeriodError is implemented by errors that represent a transient
+// upstream IdP problem -- such as providers.GroupValidationError or
+// providers.ErrProviderUnavailable -- rather than an actual validation
+// failure, so RunValidatorsWithGracePeriod can let a session through while
+// the outage is within its grace period.
+type gracePeriodError interface {
+	error
+	IsWithinGracePeriod() bool
+}
+
 type Validator interface {
 	Validate(*sessions.SessionState) error
 }
@@ -35,7 +44,7 @@ func RunValidators(validators []Validator, session *sessions.SessionState) []err
 func RunValidatorsWithGracePeriod(validators []Validator, session *sessions.SessionState) []error {
 	validatorErrors := make([]error, 0, len(validators))
 	for _, err := range RunValidators(validators, session) {
-		if err, ok := err.(*providers.GroupValidationError); ok {
+		if err, ok := err.(gracePeriodError); ok {
 			if err.IsWithinGracePeriod() {
 				continue
 			}
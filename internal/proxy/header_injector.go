@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/buzzfeed/sso/internal/pkg/sessions"
+)
+
+// HeaderRule describes a single header to set on a proxied request or
+// response, and the session claim its value comes from.
+type HeaderRule struct {
+	// Header is the name of the header to set.
+	Header string
+
+	// Claim names the session claim to source the header's value from: one
+	// of "email", "user", "groups", "access_token", or, for any other name,
+	// a provider-specific claim looked up in the session's Claims map (for
+	// example a Keycloak realm's "preferred_username" or a custom protocol
+	// mapper claim), as populated by Provider.EnrichSession.
+	Claim string
+
+	// GroupsSeparator joins the groups claim into a single header value.
+	// Defaults to ",".
+	GroupsSeparator string
+
+	// Bearer, when set on a rule with Claim "access_token", prefixes the
+	// header value with "Bearer " for upstreams that expect a standard
+	// Authorization header.
+	Bearer bool
+}
+
+// UpstreamHeaderConfig configures the header injectors for a single upstream.
+type UpstreamHeaderConfig struct {
+	// RequestHeaders are written onto the proxied request sent to the
+	// upstream.
+	RequestHeaders []HeaderRule
+
+	// ResponseHeaders are written onto the response sso_proxy returns to the
+	// client, for example to expose a signed identity assertion.
+	ResponseHeaders []HeaderRule
+}
+
+// HeaderInjector writes identity data from a sessions.SessionState --
+// including arbitrary provider-specific claims populated by EnrichSession --
+// onto proxied upstream requests, and, for a configured subset, onto the
+// response sso_proxy returns to the client, keyed by upstream host, so that
+// upstream services don't each need to implement their own session parsing
+// to learn who's making the request.
+type HeaderInjector struct {
+	configs map[string]UpstreamHeaderConfig
+}
+
+// NewHeaderInjector builds a HeaderInjector from a per-upstream-host
+// configuration map.
+func NewHeaderInjector(configs map[string]UpstreamHeaderConfig) *HeaderInjector {
+	return &HeaderInjector{configs: configs}
+}
+
+// InjectRequestHeaders strips any header this injector is configured to set
+// for upstreamHost from req -- so a client can't spoof identity by setting
+// the header itself -- then sets each configured header from s.
+func (h *HeaderInjector) InjectRequestHeaders(req *http.Request, upstreamHost string, s *sessions.SessionState) {
+	cfg, ok := h.configs[upstreamHost]
+	if !ok {
+		return
+	}
+
+	for _, rule := range cfg.RequestHeaders {
+		req.Header.Del(rule.Header)
+	}
+	for _, rule := range cfg.RequestHeaders {
+		if value, ok := claimValue(s, rule); ok {
+			req.Header.Set(rule.Header, value)
+		}
+	}
+}
+
+// InjectResponseHeaders sets each of upstreamHost's configured response
+// headers on w from s.
+func (h *HeaderInjector) InjectResponseHeaders(w http.ResponseWriter, upstreamHost string, s *sessions.SessionState) {
+	cfg, ok := h.configs[upstreamHost]
+	if !ok {
+		return
+	}
+
+	for _, rule := range cfg.ResponseHeaders {
+		if value, ok := claimValue(s, rule); ok {
+			w.Header().Set(rule.Header, value)
+		}
+	}
+}
+
+// claimValue resolves a HeaderRule's claim against the session, reporting
+// false if the claim is unknown or empty. Claims outside the fixed set of
+// well-known session fields are looked up by name in s.Claims, so an
+// upstream can be configured to receive any claim a provider's EnrichSession
+// populates there without HeaderInjector needing to know its name in advance.
+func claimValue(s *sessions.SessionState, rule HeaderRule) (string, bool) {
+	switch rule.Claim {
+	case "email":
+		return s.Email, s.Email != ""
+	case "user":
+		return s.User, s.User != ""
+	case "groups":
+		if len(s.Groups) == 0 {
+			return "", false
+		}
+		sep := rule.GroupsSeparator
+		if sep == "" {
+			sep = ","
+		}
+		return strings.Join(s.Groups, sep), true
+	case "access_token":
+		if s.AccessToken == "" {
+			return "", false
+		}
+		if rule.Bearer {
+			return "Bearer " + s.AccessToken, true
+		}
+		return s.AccessToken, true
+	default:
+		value, ok := s.Claims[rule.Claim]
+		return value, ok && value != ""
+	}
+}
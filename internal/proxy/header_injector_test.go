@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/buzzfeed/sso/internal/pkg/sessions"
+)
+
+func TestHeaderInjectorInjectRequestHeaders(t *testing.T) {
+	h := NewHeaderInjector(map[string]UpstreamHeaderConfig{
+		"upstream.internal": {
+			RequestHeaders: []HeaderRule{
+				{Header: "X-Forwarded-Email", Claim: "email"},
+				{Header: "X-Forwarded-Groups", Claim: "groups", GroupsSeparator: "|"},
+				{Header: "Authorization", Claim: "access_token", Bearer: true},
+			},
+		},
+	})
+
+	req := httptest.NewRequest("GET", "https://upstream.internal/", nil)
+	s := &sessions.SessionState{
+		Email:       "user@example.com",
+		Groups:      []string{"sre", "engineering"},
+		AccessToken: "abc123",
+	}
+
+	h.InjectRequestHeaders(req, "upstream.internal", s)
+
+	if got := req.Header.Get("X-Forwarded-Email"); got != "user@example.com" {
+		t.Errorf("expected X-Forwarded-Email to be set, got %q", got)
+	}
+	if got := req.Header.Get("X-Forwarded-Groups"); got != "sre|engineering" {
+		t.Errorf("expected groups joined with the configured separator, got %q", got)
+	}
+	if got := req.Header.Get("Authorization"); got != "Bearer abc123" {
+		t.Errorf("expected a bearer-prefixed access token, got %q", got)
+	}
+}
+
+func TestHeaderInjectorStripsSpoofedInboundHeaders(t *testing.T) {
+	h := NewHeaderInjector(map[string]UpstreamHeaderConfig{
+		"upstream.internal": {
+			RequestHeaders: []HeaderRule{
+				{Header: "X-Forwarded-Email", Claim: "email"},
+			},
+		},
+	})
+
+	req := httptest.NewRequest("GET", "https://upstream.internal/", nil)
+	req.Header.Set("X-Forwarded-Email", "attacker@evil.com")
+
+	// A session with no email at all should still result in the spoofed
+	// header being removed, not merely overwritten.
+	h.InjectRequestHeaders(req, "upstream.internal", &sessions.SessionState{})
+
+	if got := req.Header.Get("X-Forwarded-Email"); got != "" {
+		t.Errorf("expected the spoofed inbound header to be stripped, got %q", got)
+	}
+}
+
+func TestHeaderInjectorInjectResponseHeaders(t *testing.T) {
+	h := NewHeaderInjector(map[string]UpstreamHeaderConfig{
+		"upstream.internal": {
+			ResponseHeaders: []HeaderRule{
+				{Header: "X-Sso-User", Claim: "user"},
+			},
+		},
+	})
+
+	w := httptest.NewRecorder()
+	h.InjectResponseHeaders(w, "upstream.internal", &sessions.SessionState{User: "jdoe"})
+
+	if got := w.Header().Get("X-Sso-User"); got != "jdoe" {
+		t.Errorf("expected X-Sso-User to be set on the response, got %q", got)
+	}
+}
+
+func TestHeaderInjectorInjectRequestHeadersFromGenericClaim(t *testing.T) {
+	h := NewHeaderInjector(map[string]UpstreamHeaderConfig{
+		"upstream.internal": {
+			RequestHeaders: []HeaderRule{
+				{Header: "X-Forwarded-Preferred-Username", Claim: "preferred_username"},
+			},
+		},
+	})
+
+	req := httptest.NewRequest("GET", "https://upstream.internal/", nil)
+	s := &sessions.SessionState{
+		Claims: map[string]string{"preferred_username": "jdoe"},
+	}
+
+	h.InjectRequestHeaders(req, "upstream.internal", s)
+
+	if got := req.Header.Get("X-Forwarded-Preferred-Username"); got != "jdoe" {
+		t.Errorf("expected a generic claim to be forwarded, got %q", got)
+	}
+}
+
+func TestHeaderInjectorInjectRequestHeadersUnknownClaim(t *testing.T) {
+	h := NewHeaderInjector(map[string]UpstreamHeaderConfig{
+		"upstream.internal": {
+			RequestHeaders: []HeaderRule{
+				{Header: "X-Forwarded-Department", Claim: "department"},
+			},
+		},
+	})
+
+	req := httptest.NewRequest("GET", "https://upstream.internal/", nil)
+	h.InjectRequestHeaders(req, "upstream.internal", &sessions.SessionState{})
+
+	if got := req.Header.Get("X-Forwarded-Department"); got != "" {
+		t.Errorf("expected no header for a claim absent from Claims, got %q", got)
+	}
+}
+
+func TestHeaderInjectorNoConfigForHost(t *testing.T) {
+	h := NewHeaderInjector(map[string]UpstreamHeaderConfig{})
+
+	req := httptest.NewRequest("GET", "https://other.internal/", nil)
+	h.InjectRequestHeaders(req, "other.internal", &sessions.SessionState{Email: "user@example.com"})
+
+	if len(req.Header) != 0 {
+		t.Errorf("expected no headers to be set for an unconfigured upstream, got %v", req.Header)
+	}
+}
@@ -0,0 +1,273 @@
+package providers
+
+import (
+	"container/list"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buzzfeed/sso/internal/pkg/sessions"
+
+	"github.com/datadog/datadog-go/statsd"
+)
+
+// This is a compile-time check to make sure our types correctly implement the interface:
+// https://medium.com/@matryer/golang-tip-compile-time-checks-to-ensure-your-type-satisfies-an-interface-c167afed3aae
+var _ Provider = &CachingProvider{}
+
+const (
+	// DefaultCacheMaxEntries is the default bound on the number of entries
+	// held by a CachingProvider's cache.
+	DefaultCacheMaxEntries = 10000
+
+	// DefaultCacheTTL is the default time a successful lookup is cached for.
+	DefaultCacheTTL = 5 * time.Minute
+
+	// DefaultCacheNegativeTTL is the default time a failed lookup is cached
+	// for. It is intentionally shorter than DefaultCacheTTL so that an IdP
+	// outage or a group change propagates faster than a cached success would.
+	DefaultCacheNegativeTTL = 30 * time.Second
+)
+
+// CachingProviderConfig configures the bounds and expiry of a CachingProvider's cache.
+type CachingProviderConfig struct {
+	// MaxEntries bounds the number of keys held in the cache. When the bound
+	// is reached, the least recently used entry is evicted.
+	MaxEntries int
+
+	// TTL is how long a successful ValidateGroup/UserGroups/ValidateSessionToken
+	// result is cached for, used when EndpointTTLs has no entry for the endpoint.
+	TTL time.Duration
+
+	// NegativeTTL is how long a failed lookup is cached for, for every
+	// endpoint; EndpointTTLs does not override it.
+	NegativeTTL time.Duration
+
+	// EndpointTTLs overrides TTL on a per-endpoint basis (endpoint names
+	// match those passed to SingleFlightProvider.do: "ValidateGroup",
+	// "UserGroups", "ValidateSessionToken").
+	EndpointTTLs map[string]time.Duration
+}
+
+// CachingProvider middleware wraps a Provider with a bounded LRU cache, keyed
+// and TTL-bound per endpoint, so that repeated ValidateGroup, UserGroups, and
+// ValidateSessionToken calls for the same key don't all round-trip to the
+// upstream IdP. Unlike SingleFlightProvider, which only collapses requests
+// that are in flight at the same moment, CachingProvider lets sso_proxy keep
+// serving cached answers -- including cached failures, via a shorter
+// negative TTL -- across an IdP outage.
+type CachingProvider struct {
+	StatsdClient *statsd.Client
+
+	provider Provider
+
+	cfg   CachingProviderConfig
+	mu    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key       string
+	value     interface{}
+	err       error
+	expiresAt time.Time
+}
+
+// NewCachingProvider instantiates a CachingProvider given a provider, a
+// statsdClient, and a CachingProviderConfig. Zero-valued MaxEntries, TTL, and
+// NegativeTTL in cfg fall back to DefaultCacheMaxEntries, DefaultCacheTTL,
+// and DefaultCacheNegativeTTL respectively.
+func NewCachingProvider(provider Provider, statsdClient *statsd.Client, cfg CachingProviderConfig) *CachingProvider {
+	if cfg.MaxEntries <= 0 {
+		cfg.MaxEntries = DefaultCacheMaxEntries
+	}
+	if cfg.TTL <= 0 {
+		cfg.TTL = DefaultCacheTTL
+	}
+	if cfg.NegativeTTL <= 0 {
+		cfg.NegativeTTL = DefaultCacheNegativeTTL
+	}
+
+	return &CachingProvider{
+		provider:     provider,
+		StatsdClient: statsdClient,
+		cfg:          cfg,
+		ll:           list.New(),
+		items:        make(map[string]*list.Element),
+	}
+}
+
+func (p *CachingProvider) ttlFor(endpoint string, negative bool) time.Duration {
+	ttl := p.cfg.TTL
+	if negative {
+		ttl = p.cfg.NegativeTTL
+	}
+	if override, ok := p.cfg.EndpointTTLs[endpoint]; ok && !negative {
+		ttl = override
+	}
+	return ttl
+}
+
+func (p *CachingProvider) metric(name, endpoint string) {
+	tags := []string{fmt.Sprintf("endpoint:%s", endpoint)}
+	p.StatsdClient.Incr("provider.cache."+name, tags, 1)
+}
+
+// get returns the cached value for key, reporting a cache hit or miss via
+// statsd. Expired entries are evicted and treated as a miss.
+func (p *CachingProvider) get(endpoint, key string) (interface{}, error, bool) {
+	compositeKey := fmt.Sprintf("%s/%s", endpoint, key)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	el, ok := p.items[compositeKey]
+	if !ok {
+		p.metric("miss", endpoint)
+		return nil, nil, false
+	}
+
+	entry := el.Value.(*cacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		p.ll.Remove(el)
+		delete(p.items, compositeKey)
+		p.metric("evict", endpoint)
+		p.metric("miss", endpoint)
+		return nil, nil, false
+	}
+
+	p.ll.MoveToFront(el)
+	p.metric("hit", endpoint)
+	return entry.value, entry.err, true
+}
+
+// set stores value/err for key, evicting the least recently used entry if
+// the cache is at capacity. negative marks the entry as a failed lookup, so
+// it is expired after NegativeTTL rather than TTL.
+func (p *CachingProvider) set(endpoint, key string, value interface{}, err error, negative bool) {
+	compositeKey := fmt.Sprintf("%s/%s", endpoint, key)
+	ttl := p.ttlFor(endpoint, negative)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if el, ok := p.items[compositeKey]; ok {
+		p.ll.MoveToFront(el)
+		el.Value.(*cacheEntry).value = value
+		el.Value.(*cacheEntry).err = err
+		el.Value.(*cacheEntry).expiresAt = time.Now().Add(ttl)
+		return
+	}
+
+	if p.ll.Len() >= p.cfg.MaxEntries {
+		oldest := p.ll.Back()
+		if oldest != nil {
+			p.ll.Remove(oldest)
+			delete(p.items, oldest.Value.(*cacheEntry).key)
+			p.metric("evict", endpoint)
+		}
+	}
+
+	entry := &cacheEntry{
+		key:       compositeKey,
+		value:     value,
+		err:       err,
+		expiresAt: time.Now().Add(ttl),
+	}
+	p.items[compositeKey] = p.ll.PushFront(entry)
+}
+
+// Data calls the provider's Data function
+func (p *CachingProvider) Data() *ProviderData {
+	return p.provider.Data()
+}
+
+// Redeem takes the redirectURL and a code and calls the provider function Redeem
+func (p *CachingProvider) Redeem(redirectURL, code string) (*sessions.SessionState, error) {
+	return p.provider.Redeem(redirectURL, code)
+}
+
+// EnrichSession calls the provider's EnrichSession function
+func (p *CachingProvider) EnrichSession(s *sessions.SessionState) error {
+	return p.provider.EnrichSession(s)
+}
+
+// ValidateGroup takes an email, allowedGroups, and accessToken, serving the
+// answer out of cache when available and otherwise delegating to the
+// provider and caching the result -- including a negative result, for
+// NegativeTTL -- for next time.
+func (p *CachingProvider) ValidateGroup(email string, allowedGroups []string, accessToken string) ([]string, bool, error) {
+	sort.Strings(allowedGroups)
+	key := fmt.Sprintf("%s:%s", email, strings.Join(allowedGroups, ","))
+
+	type response struct {
+		InGroups []string
+		Allowed  bool
+	}
+
+	if cached, cachedErr, ok := p.get("ValidateGroup", key); ok {
+		if cachedErr != nil {
+			return nil, false, cachedErr
+		}
+		r := cached.(*response)
+		return r.InGroups, r.Allowed, nil
+	}
+
+	inGroups, allowed, err := p.provider.ValidateGroup(email, allowedGroups, accessToken)
+	p.set("ValidateGroup", key, &response{InGroups: inGroups, Allowed: allowed}, err, err != nil || !allowed)
+	return inGroups, allowed, err
+}
+
+// UserGroups takes an email and passes it to the provider's UserGroups
+// function, caching the response for TTL, or an error for NegativeTTL.
+func (p *CachingProvider) UserGroups(email string, groups []string, accessToken string) ([]string, error) {
+	sort.Strings(groups)
+	key := fmt.Sprintf("%s:%s", email, strings.Join(groups, ","))
+
+	if cached, cachedErr, ok := p.get("UserGroups", key); ok {
+		if cachedErr != nil {
+			return nil, cachedErr
+		}
+		return cached.([]string), nil
+	}
+
+	userGroups, err := p.provider.UserGroups(email, groups, accessToken)
+	p.set("UserGroups", key, userGroups, err, err != nil)
+	return userGroups, err
+}
+
+// ValidateSessionToken calls the provider's ValidateSessionToken function,
+// caching the boolean result keyed by access token. A false result is cached
+// under NegativeTTL so a token that's revoked mid-outage doesn't stay valid
+// in cache for the full TTL.
+func (p *CachingProvider) ValidateSessionToken(s *sessions.SessionState) bool {
+	if cached, _, ok := p.get("ValidateSessionToken", s.AccessToken); ok {
+		return cached.(bool)
+	}
+
+	valid := p.provider.ValidateSessionToken(s)
+	p.set("ValidateSessionToken", s.AccessToken, valid, nil, !valid)
+	return valid
+}
+
+// RefreshSessionToken takes in a SessionState and returns false if the
+// session is not refreshed and true if it is. Refreshes are never cached --
+// each call must reach the provider, since a stale cached refresh would hand
+// back tokens that are no longer valid.
+func (p *CachingProvider) RefreshSessionToken(s *sessions.SessionState) (bool, error) {
+	return p.provider.RefreshSessionToken(s)
+}
+
+// GetSignInURL calls the GetSignInURL for the provider, which will return the sign in url
+func (p *CachingProvider) GetSignInURL(redirectURI *url.URL, finalRedirect string) *url.URL {
+	return p.provider.GetSignInURL(redirectURI, finalRedirect)
+}
+
+// GetSignOutURL calls the GetSignOutURL for the provider, which will return the sign out url
+func (p *CachingProvider) GetSignOutURL(redirectURI *url.URL) *url.URL {
+	return p.provider.GetSignOutURL(redirectURI)
+}
@@ -0,0 +1,184 @@
+package providers
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buzzfeed/sso/internal/pkg/sessions"
+
+	"github.com/datadog/datadog-go/statsd"
+)
+
+// newTestStatsdClient returns a real *statsd.Client -- the zero value panics
+// the moment it's asked to emit a metric, since its internal writer is nil --
+// pointed at a UDP address with nothing listening, so code under test can
+// emit metrics the same way it does in production without needing a
+// collector running.
+func newTestStatsdClient(t *testing.T) *statsd.Client {
+	t.Helper()
+	client, err := statsd.New("127.0.0.1:1", statsd.WithoutClientSideAggregation())
+	if err != nil {
+		t.Fatalf("unable to construct statsd client: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// countingProvider wraps a Provider and counts calls made to it, so tests
+// can assert on whether CachingProvider actually avoided a round trip.
+type countingProvider struct {
+	Provider
+	validateGroupCalls int
+	userGroupsCalls    int
+	validateTokenCalls int
+
+	validateGroupErr error
+}
+
+func (c *countingProvider) ValidateGroup(email string, allowedGroups []string, accessToken string) ([]string, bool, error) {
+	c.validateGroupCalls++
+	if c.validateGroupErr != nil {
+		return nil, false, c.validateGroupErr
+	}
+	return []string{"sre"}, true, nil
+}
+
+func (c *countingProvider) UserGroups(email string, groups []string, accessToken string) ([]string, error) {
+	c.userGroupsCalls++
+	return []string{"sre", "engineering"}, nil
+}
+
+func (c *countingProvider) ValidateSessionToken(s *sessions.SessionState) bool {
+	c.validateTokenCalls++
+	return true
+}
+
+func newTestCachingProvider(t *testing.T, inner *countingProvider, cfg CachingProviderConfig) *CachingProvider {
+	return NewCachingProvider(inner, newTestStatsdClient(t), cfg)
+}
+
+func TestCachingProviderValidateGroupCachesHit(t *testing.T) {
+	inner := &countingProvider{}
+	p := newTestCachingProvider(t, inner, CachingProviderConfig{})
+
+	for i := 0; i < 3; i++ {
+		_, allowed, err := p.ValidateGroup("user@example.com", []string{"sre"}, "token")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !allowed {
+			t.Fatalf("expected allowed")
+		}
+	}
+
+	if inner.validateGroupCalls != 1 {
+		t.Errorf("expected exactly one upstream call, got %d", inner.validateGroupCalls)
+	}
+}
+
+func TestCachingProviderUserGroupsDifferentKeysMiss(t *testing.T) {
+	inner := &countingProvider{}
+	p := newTestCachingProvider(t, inner, CachingProviderConfig{})
+
+	p.UserGroups("a@example.com", nil, "token")
+	p.UserGroups("b@example.com", nil, "token")
+
+	if inner.userGroupsCalls != 2 {
+		t.Errorf("expected a cache miss per distinct email, got %d calls", inner.userGroupsCalls)
+	}
+}
+
+func TestCachingProviderNegativeCacheExpiresFaster(t *testing.T) {
+	inner := &countingProvider{validateGroupErr: errors.New("idp unavailable")}
+	p := newTestCachingProvider(t, inner, CachingProviderConfig{
+		TTL:         0,
+		NegativeTTL: 0,
+	})
+	// force a negative TTL so small it's already expired by the time we check
+	p.cfg.NegativeTTL = -1
+
+	_, _, err := p.ValidateGroup("user@example.com", []string{"sre"}, "token")
+	if err == nil {
+		t.Fatalf("expected the upstream error to surface")
+	}
+
+	_, _, err = p.ValidateGroup("user@example.com", []string{"sre"}, "token")
+	if err == nil {
+		t.Fatalf("expected the upstream error to surface again")
+	}
+
+	if inner.validateGroupCalls != 2 {
+		t.Errorf("expected the negative cache entry to have already expired, got %d calls", inner.validateGroupCalls)
+	}
+}
+
+func TestCachingProviderEvictsLeastRecentlyUsedAtCapacity(t *testing.T) {
+	inner := &countingProvider{}
+	p := newTestCachingProvider(t, inner, CachingProviderConfig{MaxEntries: 1})
+
+	p.ValidateSessionToken(&sessions.SessionState{AccessToken: "token-a"})
+	p.ValidateSessionToken(&sessions.SessionState{AccessToken: "token-b"})
+	// token-a should have been evicted to make room for token-b
+	p.ValidateSessionToken(&sessions.SessionState{AccessToken: "token-a"})
+
+	if inner.validateTokenCalls != 3 {
+		t.Errorf("expected 3 upstream calls once token-a was evicted, got %d", inner.validateTokenCalls)
+	}
+}
+
+func TestCachingProviderEmitsHitMissMetrics(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to open a udp listener: %v", err)
+	}
+	defer conn.Close()
+
+	statsdClient, err := statsd.New(conn.LocalAddr().String(), statsd.WithoutClientSideAggregation())
+	if err != nil {
+		t.Fatalf("unable to construct statsd client: %v", err)
+	}
+	defer statsdClient.Close()
+
+	inner := &countingProvider{}
+	p := NewCachingProvider(inner, statsdClient, CachingProviderConfig{})
+
+	p.ValidateSessionToken(&sessions.SessionState{AccessToken: "token-a"})
+	p.ValidateSessionToken(&sessions.SessionState{AccessToken: "token-a"})
+	statsdClient.Flush()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var sawMiss, sawHit bool
+	buf := make([]byte, 4096)
+	for !sawMiss || !sawHit {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		packet := string(buf[:n])
+		sawMiss = sawMiss || strings.Contains(packet, "provider.cache.miss")
+		sawHit = sawHit || strings.Contains(packet, "provider.cache.hit")
+	}
+
+	if !sawMiss {
+		t.Errorf("expected a provider.cache.miss metric to be emitted")
+	}
+	if !sawHit {
+		t.Errorf("expected a provider.cache.hit metric to be emitted")
+	}
+}
+
+func TestCachingProviderPassesThroughUncachedMethods(t *testing.T) {
+	signIn, _ := url.Parse("https://idp.example.com/auth")
+	inner := &countingProvider{Provider: &KeycloakProvider{ProviderData: &ProviderData{SignInURL: signIn}}}
+	p := newTestCachingProvider(t, inner, CachingProviderConfig{})
+
+	redirectURI, _ := url.Parse("https://sso.example.com/callback")
+	got := p.GetSignInURL(redirectURI, "/final")
+	if got.Host != signIn.Host {
+		t.Errorf("expected GetSignInURL to pass through to the underlying provider, got %v", got)
+	}
+}
@@ -0,0 +1,215 @@
+package providers
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// breakerState is the state of a single endpoint's circuit breaker.
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+// BreakerConfig bounds how much load SingleFlightProvider will send to a
+// single endpoint before it starts short-circuiting with ErrProviderUnavailable.
+type BreakerConfig struct {
+	// WindowSize is how many of the most recent results are considered when
+	// computing an endpoint's rolling error rate.
+	WindowSize int
+
+	// MinRequests is how many results must have landed in the window before
+	// the error rate is evaluated, so a handful of early failures can't trip
+	// the breaker before there's enough signal.
+	MinRequests int
+
+	// ErrorThreshold is the rolling error rate, in [0, 1], above which the
+	// breaker opens.
+	ErrorThreshold float64
+
+	// MaxInFlight bounds the number of concurrent requests to an endpoint;
+	// once reached, further requests short-circuit regardless of error rate.
+	MaxInFlight int
+
+	// OpenDuration is how long the breaker stays open before allowing a
+	// single half-open probe request through.
+	OpenDuration time.Duration
+
+	// GracePeriod is how long an ErrProviderUnavailable returned while the
+	// breaker is open remains within grace for RunValidatorsWithGracePeriod.
+	GracePeriod time.Duration
+}
+
+// DefaultBreakerConfig is used by NewSingleFlightProvider.
+var DefaultBreakerConfig = BreakerConfig{
+	WindowSize:     20,
+	MinRequests:    10,
+	ErrorThreshold: 0.5,
+	MaxInFlight:    100,
+	OpenDuration:   30 * time.Second,
+	GracePeriod:    5 * time.Minute,
+}
+
+// ErrProviderUnavailable is returned by SingleFlightProvider.do when an
+// endpoint's circuit breaker is open or its concurrency budget is exhausted.
+// It implements the same grace-period contract as GroupValidationError so
+// RunValidatorsWithGracePeriod can treat a breaker trip as a transient IdP
+// outage rather than an immediate validation failure.
+type ErrProviderUnavailable struct {
+	Endpoint string
+	Opened   time.Time
+	Grace    time.Duration
+}
+
+func (e *ErrProviderUnavailable) Error() string {
+	return fmt.Sprintf("provider: %s is unavailable (circuit breaker open or concurrency budget exhausted)", e.Endpoint)
+}
+
+// IsWithinGracePeriod reports whether the breaker tripped recently enough
+// that RunValidatorsWithGracePeriod should let the request through anyway.
+func (e *ErrProviderUnavailable) IsWithinGracePeriod() bool {
+	return time.Since(e.Opened) < e.Grace
+}
+
+// endpointBreaker tracks in-flight requests and a rolling error rate for a
+// single endpoint (e.g. "ValidateGroup", "UserGroups").
+type endpointBreaker struct {
+	mu  sync.Mutex
+	cfg BreakerConfig
+
+	state    breakerState
+	openedAt time.Time
+	inFlight int
+
+	window    []bool
+	windowPos int
+	windowLen int
+
+	halfOpenInFlight bool
+}
+
+func newEndpointBreaker(cfg BreakerConfig) *endpointBreaker {
+	return &endpointBreaker{
+		cfg:    cfg,
+		window: make([]bool, cfg.WindowSize),
+	}
+}
+
+// admit decides whether a new request to this endpoint may proceed. It
+// returns ok=false when the caller should short-circuit with
+// ErrProviderUnavailable. When the breaker is open but OpenDuration has
+// elapsed, it admits exactly one probe request and reports probe=true.
+func (b *endpointBreaker) admit() (ok bool, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.inFlight >= b.cfg.MaxInFlight {
+		return false, false
+	}
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cfg.OpenDuration {
+			return false, false
+		}
+		if b.halfOpenInFlight {
+			// A probe is already outstanding; keep failing fast until it resolves.
+			return false, false
+		}
+		b.state = breakerHalfOpen
+		b.halfOpenInFlight = true
+		b.inFlight++
+		return true, true
+	case breakerHalfOpen:
+		if b.halfOpenInFlight {
+			return false, false
+		}
+		b.halfOpenInFlight = true
+		b.inFlight++
+		return true, true
+	default:
+		b.inFlight++
+		return true, false
+	}
+}
+
+// release records the result of a request admitted by admit, updating the
+// rolling error rate and, if this was a half-open probe, closing the breaker
+// on success or re-opening it on failure.
+func (b *endpointBreaker) release(probe bool, success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.inFlight--
+
+	if probe {
+		b.halfOpenInFlight = false
+		if success {
+			b.reset()
+		} else {
+			b.trip()
+		}
+		return
+	}
+
+	b.record(success)
+	if b.state == breakerClosed && b.windowLen >= b.cfg.MinRequests && b.errorRate() > b.cfg.ErrorThreshold {
+		b.trip()
+	}
+}
+
+func (b *endpointBreaker) record(success bool) {
+	b.window[b.windowPos] = success
+	b.windowPos = (b.windowPos + 1) % len(b.window)
+	if b.windowLen < len(b.window) {
+		b.windowLen++
+	}
+}
+
+func (b *endpointBreaker) errorRate() float64 {
+	if b.windowLen == 0 {
+		return 0
+	}
+	failures := 0
+	for i := 0; i < b.windowLen; i++ {
+		if !b.window[i] {
+			failures++
+		}
+	}
+	return float64(failures) / float64(b.windowLen)
+}
+
+func (b *endpointBreaker) trip() {
+	b.state = breakerOpen
+	b.openedAt = time.Now()
+}
+
+func (b *endpointBreaker) reset() {
+	b.state = breakerClosed
+	b.windowPos = 0
+	b.windowLen = 0
+}
+
+// snapshot returns the breaker's current state as a statsd gauge value
+// (0=closed, 1=half-open, 2=open) along with the in-flight count.
+func (b *endpointBreaker) snapshot() (state int, inFlight int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return int(b.state), b.inFlight
+}
+
+// openedAtOrNow returns the time the breaker tripped open, or the current
+// time if it isn't open -- used to anchor ErrProviderUnavailable's grace
+// period to when the outage actually began.
+func (b *endpointBreaker) openedAtOrNow() time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen {
+		return b.openedAt
+	}
+	return time.Now()
+}
@@ -0,0 +1,124 @@
+package providers
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// flakyProvider fails its first N calls to ValidateGroup, then succeeds.
+type flakyProvider struct {
+	Provider
+	failuresLeft int
+	calls        int
+}
+
+func (f *flakyProvider) ValidateGroup(email string, allowedGroups []string, accessToken string) ([]string, bool, error) {
+	f.calls++
+	if f.failuresLeft > 0 {
+		f.failuresLeft--
+		return nil, false, errors.New("idp unavailable")
+	}
+	return []string{"sre"}, true, nil
+}
+
+func TestNewSingleFlightProviderDefaultsZeroValuedBreakerConfigFields(t *testing.T) {
+	p := NewSingleFlightProvider(&flakyProvider{}, newTestStatsdClient(t), BreakerConfig{MaxInFlight: 5})
+
+	if p.breakerCfg.MaxInFlight != 5 {
+		t.Errorf("expected the caller's MaxInFlight to be preserved, got %d", p.breakerCfg.MaxInFlight)
+	}
+	if p.breakerCfg.WindowSize != DefaultBreakerConfig.WindowSize {
+		t.Errorf("expected a zero-valued WindowSize to default to DefaultBreakerConfig, got %d", p.breakerCfg.WindowSize)
+	}
+	if p.breakerCfg.ErrorThreshold != DefaultBreakerConfig.ErrorThreshold {
+		t.Errorf("expected a zero-valued ErrorThreshold to default to DefaultBreakerConfig, got %v", p.breakerCfg.ErrorThreshold)
+	}
+}
+
+func TestSingleFlightProviderBreakerTripsAfterErrorThreshold(t *testing.T) {
+	inner := &flakyProvider{failuresLeft: 1000}
+	p := NewSingleFlightProvider(inner, newTestStatsdClient(t), BreakerConfig{
+		WindowSize:     10,
+		MinRequests:    5,
+		ErrorThreshold: 0.5,
+		MaxInFlight:    100,
+		OpenDuration:   time.Hour,
+		GracePeriod:    time.Minute,
+	})
+
+	var lastErr error
+	for i := 0; i < 6; i++ {
+		_, _, lastErr = p.ValidateGroup("user@example.com", []string{"sre"}, "token")
+	}
+
+	if _, ok := lastErr.(*ErrProviderUnavailable); !ok {
+		t.Fatalf("expected the breaker to trip and return ErrProviderUnavailable, got %v", lastErr)
+	}
+
+	callsBeforeTrip := inner.calls
+	p.ValidateGroup("user@example.com", []string{"sre"}, "token")
+	if inner.calls != callsBeforeTrip {
+		t.Errorf("expected the open breaker to short-circuit without calling the provider, got %d calls", inner.calls)
+	}
+}
+
+func TestSingleFlightProviderBreakerGracePeriod(t *testing.T) {
+	err := &ErrProviderUnavailable{Endpoint: "ValidateGroup", Opened: time.Now(), Grace: time.Minute}
+	if !err.IsWithinGracePeriod() {
+		t.Errorf("expected a freshly opened breaker's error to be within its grace period")
+	}
+
+	expired := &ErrProviderUnavailable{Endpoint: "ValidateGroup", Opened: time.Now().Add(-time.Hour), Grace: time.Minute}
+	if expired.IsWithinGracePeriod() {
+		t.Errorf("expected an error opened an hour ago with a 1 minute grace period to be outside it")
+	}
+}
+
+func TestSingleFlightProviderBreakerHalfOpenRecovery(t *testing.T) {
+	inner := &flakyProvider{failuresLeft: 5}
+	p := NewSingleFlightProvider(inner, newTestStatsdClient(t), BreakerConfig{
+		WindowSize:     10,
+		MinRequests:    3,
+		ErrorThreshold: 0.5,
+		MaxInFlight:    100,
+		OpenDuration:   20 * time.Millisecond,
+		GracePeriod:    time.Minute,
+	})
+
+	var lastErr error
+	for i := 0; i < 4; i++ {
+		_, _, lastErr = p.ValidateGroup("user@example.com", []string{"sre"}, "token")
+	}
+	if _, ok := lastErr.(*ErrProviderUnavailable); !ok {
+		t.Fatalf("expected the breaker to be open, got %v", lastErr)
+	}
+
+	// Still within OpenDuration: should short-circuit without reaching the provider.
+	callsWhileOpen := inner.calls
+	p.ValidateGroup("user@example.com", []string{"sre"}, "token")
+	if inner.calls != callsWhileOpen {
+		t.Fatalf("expected no calls while the breaker is open, got %d", inner.calls)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	inner.failuresLeft = 0 // the next call (the probe) will succeed
+
+	_, allowed, err := p.ValidateGroup("user@example.com", []string{"sre"}, "token")
+	if err != nil {
+		t.Fatalf("expected the half-open probe to succeed and close the breaker, got %v", err)
+	}
+	if !allowed {
+		t.Fatalf("expected the probe's successful result to be returned")
+	}
+
+	// The breaker should now be closed, and subsequent calls should reach the provider normally.
+	callsBeforeClose := inner.calls
+	_, _, err = p.ValidateGroup("user@example.com", []string{"sre"}, "token")
+	if err != nil {
+		t.Fatalf("unexpected error once the breaker is closed: %v", err)
+	}
+	if inner.calls != callsBeforeClose+1 {
+		t.Errorf("expected the provider to be called once the breaker re-closed, got %d calls", inner.calls)
+	}
+}
@@ -0,0 +1,395 @@
+package providers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/buzzfeed/sso/internal/pkg/sessions"
+)
+
+// This is a compile-time check to make sure our types correctly implement the interface:
+// https://medium.com/@matryer/golang-tip-compile-time-checks-to-ensure-your-type-satisfies-an-interface-c167afed3aae
+var _ Provider = &KeycloakProvider{}
+
+// ErrMissingGroupsClaim is returned when the access token has no usable
+// groups claim and the provider has no UserInfoURL configured to fall back
+// to -- not when a fallback lookup simply finds the user in zero groups.
+var ErrMissingGroupsClaim = errors.New("keycloak: access token is missing the groups claim")
+
+// KeycloakProvider wraps a Keycloak realm's OIDC endpoints. It resolves group
+// membership from the configured GroupsClaim plus any realm_access/
+// resource_access role claims embedded in the access token, falling back to
+// the realm's userinfo endpoint when none of those are present (for example,
+// when a client's protocol mapper exposes roles under a different flow).
+type KeycloakProvider struct {
+	ProviderData *ProviderData
+
+	// UserInfoURL is the realm's OIDC userinfo endpoint, used as a fallback
+	// source of group membership when the access token has no groups claim.
+	UserInfoURL *url.URL
+
+	// GroupsClaim is the name of the claim that carries group membership.
+	// Defaults to "groups".
+	GroupsClaim string
+
+	HTTPClient *http.Client
+}
+
+// NewKeycloakProvider creates a KeycloakProvider from the realm's ProviderData,
+// filling in the GroupsClaim and HTTPClient with their defaults when unset.
+func NewKeycloakProvider(p *ProviderData) *KeycloakProvider {
+	k := &KeycloakProvider{
+		ProviderData: p,
+		GroupsClaim:  "groups",
+		HTTPClient:   http.DefaultClient,
+	}
+	return k
+}
+
+// Data calls the provider's Data function
+func (p *KeycloakProvider) Data() *ProviderData {
+	return p.ProviderData
+}
+
+// keycloakTokenResponse is the body of a Keycloak token endpoint response.
+type keycloakTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	IDToken      string `json:"id_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	Error        string `json:"error"`
+	ErrorDesc    string `json:"error_description"`
+}
+
+// keycloakAccessTokenClaims is the subset of access token claims KeycloakProvider cares about.
+type keycloakAccessTokenClaims struct {
+	Email             string   `json:"email"`
+	PreferredUsername string   `json:"preferred_username"`
+	ExpiresAt         int64    `json:"exp"`
+	Groups            []string `json:"groups"`
+
+	// raw holds every claim in the decoded access token, string-valued or
+	// not, so EnrichSession can forward provider-specific claims onto the
+	// session's generic Claims map without KeycloakProvider hardcoding
+	// their names.
+	raw map[string]json.RawMessage
+}
+
+// stringClaims flattens the string-valued entries of a decoded JWT payload
+// into a plain map, for HeaderInjector to forward claims sso_proxy has no
+// fixed SessionState field for (preferred_username, sub, or anything a
+// realm's protocol mappers add) without needing to know their names ahead
+// of time.
+func stringClaims(raw map[string]json.RawMessage) map[string]string {
+	claims := make(map[string]string, len(raw))
+	for name, v := range raw {
+		var s string
+		if err := json.Unmarshal(v, &s); err == nil {
+			claims[name] = s
+		}
+	}
+	return claims
+}
+
+// keycloakRealmAccess is the realm_access claim Keycloak embeds in access
+// tokens, carrying the realm-level roles assigned to the user.
+type keycloakRealmAccess struct {
+	Roles []string `json:"roles"`
+}
+
+// keycloakResourceAccess is the resource_access claim Keycloak embeds in
+// access tokens, keyed by client ID, carrying that client's roles.
+type keycloakResourceAccess struct {
+	Roles []string `json:"roles"`
+}
+
+// groupsFromClaims resolves group membership from a decoded claims set: the
+// configured GroupsClaim (a flat array of group names or role names, per the
+// realm's protocol mapper), plus, when present, the realm and client roles
+// Keycloak embeds under realm_access and resource_access -- this is what
+// lets ValidateGroup/UserGroups work against Keycloak realm/client roles
+// rather than requiring a dedicated groups mapper.
+func (p *KeycloakProvider) groupsFromClaims(raw map[string]json.RawMessage) []string {
+	var groups []string
+
+	if v, ok := raw[p.GroupsClaim]; ok {
+		var claimed []string
+		if err := json.Unmarshal(v, &claimed); err == nil {
+			groups = append(groups, claimed...)
+		}
+	}
+
+	if v, ok := raw["realm_access"]; ok {
+		var realmAccess keycloakRealmAccess
+		if err := json.Unmarshal(v, &realmAccess); err == nil {
+			groups = append(groups, realmAccess.Roles...)
+		}
+	}
+
+	if v, ok := raw["resource_access"]; ok {
+		var resourceAccess map[string]keycloakResourceAccess
+		if err := json.Unmarshal(v, &resourceAccess); err == nil {
+			if client, ok := resourceAccess[p.ProviderData.ClientID]; ok {
+				groups = append(groups, client.Roles...)
+			}
+		}
+	}
+
+	return groups
+}
+
+// Redeem exchanges the authorization code for a token set at the realm's
+// token endpoint and returns a SessionState populated with the tokens. Call
+// EnrichSession to resolve the session's email, username, and groups.
+func (p *KeycloakProvider) Redeem(redirectURL, code string) (*sessions.SessionState, error) {
+	if p.ProviderData.RedeemURL == nil || p.ProviderData.RedeemURL.String() == "" {
+		return nil, errors.New("missing redeem url")
+	}
+
+	params := url.Values{}
+	params.Set("grant_type", "authorization_code")
+	params.Set("redirect_uri", redirectURL)
+	params.Set("code", code)
+	params.Set("client_id", p.ProviderData.ClientID)
+	params.Set("client_secret", p.ProviderData.ClientSecret)
+
+	var resp keycloakTokenResponse
+	err := p.postForm(p.ProviderData.RedeemURL.String(), params, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("keycloak: token endpoint returned error: %s: %s", resp.Error, resp.ErrorDesc)
+	}
+
+	return &sessions.SessionState{
+		AccessToken:  resp.AccessToken,
+		RefreshToken: resp.RefreshToken,
+		ExpiresOn:    time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second),
+	}, nil
+}
+
+// EnrichSession fills in the email, username, groups, and generic Claims map
+// for a SessionState returned by Redeem or RefreshSessionToken, preferring
+// the groups claim embedded in the session's access token and falling back
+// to the userinfo endpoint.
+func (p *KeycloakProvider) EnrichSession(s *sessions.SessionState) error {
+	claims, err := p.claimsFromAccessToken(s.AccessToken)
+	if err != nil {
+		return err
+	}
+
+	groups := claims.Groups
+	if len(groups) == 0 {
+		groups, err = p.groupsFromUserInfo(s.AccessToken)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.Email = claims.Email
+	s.User = claims.PreferredUsername
+	s.Groups = groups
+	s.Claims = stringClaims(claims.raw)
+	return nil
+}
+
+// ValidateGroup compares the user's groups, as reported by UserGroups,
+// against allowedGroups and reports whether the user is a member of any of
+// them.
+func (p *KeycloakProvider) ValidateGroup(email string, allowedGroups []string, accessToken string) ([]string, bool, error) {
+	userGroups, err := p.UserGroups(email, allowedGroups, accessToken)
+	if err != nil {
+		return nil, false, err
+	}
+
+	allowed := map[string]struct{}{}
+	for _, g := range allowedGroups {
+		allowed[g] = struct{}{}
+	}
+
+	var inGroups []string
+	for _, g := range userGroups {
+		if _, ok := allowed[g]; ok {
+			inGroups = append(inGroups, g)
+		}
+	}
+
+	return inGroups, len(inGroups) > 0, nil
+}
+
+// UserGroups resolves the caller's group membership from the access token's
+// groups claim, falling back to the realm's userinfo endpoint when the claim
+// is not present.
+func (p *KeycloakProvider) UserGroups(email string, groups []string, accessToken string) ([]string, error) {
+	claims, err := p.claimsFromAccessToken(accessToken)
+	if err != nil {
+		return nil, err
+	}
+	if len(claims.Groups) > 0 {
+		return claims.Groups, nil
+	}
+	return p.groupsFromUserInfo(accessToken)
+}
+
+// ValidateSessionToken reports whether the session's access token is still
+// unexpired. This is independent of group membership: a user who
+// legitimately belongs to zero Keycloak groups still has a valid session,
+// and conflating the two would make ValidateSessionToken fail for every
+// realm that doesn't set UserInfoURL. ValidateGroup/UserGroups is where
+// group membership is actually enforced.
+func (p *KeycloakProvider) ValidateSessionToken(s *sessions.SessionState) bool {
+	claims, err := p.claimsFromAccessToken(s.AccessToken)
+	if err != nil {
+		return false
+	}
+	if claims.ExpiresAt == 0 {
+		return true
+	}
+	return time.Now().Before(time.Unix(claims.ExpiresAt, 0))
+}
+
+// RefreshSessionToken takes in a SessionState and refreshes its access token
+// via the realm's token endpoint, returning false if the refresh token is
+// rejected.
+func (p *KeycloakProvider) RefreshSessionToken(s *sessions.SessionState) (bool, error) {
+	if s.RefreshToken == "" {
+		return false, nil
+	}
+
+	params := url.Values{}
+	params.Set("grant_type", "refresh_token")
+	params.Set("refresh_token", s.RefreshToken)
+	params.Set("client_id", p.ProviderData.ClientID)
+	params.Set("client_secret", p.ProviderData.ClientSecret)
+
+	var resp keycloakTokenResponse
+	err := p.postForm(p.ProviderData.RedeemURL.String(), params, &resp)
+	if err != nil {
+		return false, err
+	}
+	if resp.Error != "" {
+		return false, nil
+	}
+
+	s.AccessToken = resp.AccessToken
+	s.RefreshToken = resp.RefreshToken
+	s.ExpiresOn = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+	return true, nil
+}
+
+// GetSignInURL calls the GetSignInURL for the provider, which will return the sign in url
+func (p *KeycloakProvider) GetSignInURL(redirectURI *url.URL, finalRedirect string) *url.URL {
+	a := *p.ProviderData.SignInURL
+	params, _ := url.ParseQuery(a.RawQuery)
+	params.Set("client_id", p.ProviderData.ClientID)
+	params.Set("response_type", "code")
+	params.Set("redirect_uri", redirectURI.String())
+	params.Set("state", finalRedirect)
+	a.RawQuery = params.Encode()
+	return &a
+}
+
+// GetSignOutURL calls the GetSignOutURL for the provider, which will return the sign out url
+func (p *KeycloakProvider) GetSignOutURL(redirectURI *url.URL) *url.URL {
+	a := *p.ProviderData.SignOutURL
+	params, _ := url.ParseQuery(a.RawQuery)
+	params.Set("client_id", p.ProviderData.ClientID)
+	params.Set("post_logout_redirect_uri", redirectURI.String())
+	a.RawQuery = params.Encode()
+	return &a
+}
+
+func (p *KeycloakProvider) postForm(endpoint string, params url.Values, out interface{}) error {
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// claimsFromAccessToken extracts the claims we care about from the JWT access
+// token's payload segment, without verifying its signature -- the token was
+// just issued to us directly by the realm's token endpoint over TLS.
+func (p *KeycloakProvider) claimsFromAccessToken(accessToken string) (*keycloakAccessTokenClaims, error) {
+	parts := strings.Split(accessToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("keycloak: access token is not a valid jwt")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("keycloak: unable to decode access token payload: %v", err)
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &raw); err != nil {
+		return nil, fmt.Errorf("keycloak: unable to unmarshal access token claims: %v", err)
+	}
+
+	claims := &keycloakAccessTokenClaims{}
+	if v, ok := raw["email"]; ok {
+		json.Unmarshal(v, &claims.Email)
+	}
+	if v, ok := raw["preferred_username"]; ok {
+		json.Unmarshal(v, &claims.PreferredUsername)
+	}
+	if v, ok := raw["exp"]; ok {
+		json.Unmarshal(v, &claims.ExpiresAt)
+	}
+	claims.Groups = p.groupsFromClaims(raw)
+	claims.raw = raw
+
+	return claims, nil
+}
+
+// groupsFromUserInfo calls the realm's userinfo endpoint and returns the
+// configured GroupsClaim from the response. A realm whose userinfo response
+// carries no groups at all for an otherwise-valid user returns (nil, nil) --
+// that's a user who simply belongs to no groups, not an error.
+func (p *KeycloakProvider) groupsFromUserInfo(accessToken string) ([]string, error) {
+	if p.UserInfoURL == nil {
+		return nil, ErrMissingGroupsClaim
+	}
+
+	req, err := http.NewRequest("GET", p.UserInfoURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("keycloak: userinfo endpoint returned %d", resp.StatusCode)
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	var groups []string
+	if v, ok := raw[p.GroupsClaim]; ok {
+		json.Unmarshal(v, &groups)
+	}
+	return groups, nil
+}
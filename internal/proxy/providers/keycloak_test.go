@@ -0,0 +1,305 @@
+package providers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/buzzfeed/sso/internal/pkg/sessions"
+)
+
+func encodeJWT(t *testing.T, claims interface{}) string {
+	t.Helper()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("unable to marshal claims: %v", err)
+	}
+	return header + "." + base64.RawURLEncoding.EncodeToString(payload) + ".sig"
+}
+
+func newTestKeycloakProvider(t *testing.T, tokenHandler, userInfoHandler http.HandlerFunc) (*KeycloakProvider, *httptest.Server) {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	if tokenHandler != nil {
+		mux.HandleFunc("/protocol/openid-connect/token", tokenHandler)
+	}
+	if userInfoHandler != nil {
+		mux.HandleFunc("/protocol/openid-connect/userinfo", userInfoHandler)
+	}
+	srv := httptest.NewServer(mux)
+
+	redeemURL, _ := url.Parse(srv.URL + "/protocol/openid-connect/token")
+	userInfoURL, _ := url.Parse(srv.URL + "/protocol/openid-connect/userinfo")
+
+	p := NewKeycloakProvider(&ProviderData{
+		ProviderName: "keycloak",
+		ClientID:     "sso-proxy",
+		ClientSecret: "secret",
+		RedeemURL:    redeemURL,
+	})
+	p.UserInfoURL = userInfoURL
+	return p, srv
+}
+
+func TestKeycloakProviderRedeemDoesNotEnrichSession(t *testing.T) {
+	accessToken := encodeJWT(t, keycloakAccessTokenClaims{
+		Email:             "user@example.com",
+		PreferredUsername: "user",
+		Groups:            []string{"engineering", "sre"},
+	})
+
+	p, srv := newTestKeycloakProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(keycloakTokenResponse{
+			AccessToken:  accessToken,
+			RefreshToken: "refresh-1",
+			ExpiresIn:    3600,
+		})
+	}, nil)
+	defer srv.Close()
+
+	session, err := p.Redeem("https://sso.example.com/callback", "code-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if session.AccessToken != accessToken {
+		t.Errorf("expected the access token to be set, got %q", session.AccessToken)
+	}
+	if session.Email != "" || session.Groups != nil {
+		t.Errorf("expected Redeem to leave email/groups unset, got email=%q groups=%v", session.Email, session.Groups)
+	}
+}
+
+func TestKeycloakProviderEnrichSessionUsesGroupsClaim(t *testing.T) {
+	accessToken := encodeJWT(t, keycloakAccessTokenClaims{
+		Email:             "user@example.com",
+		PreferredUsername: "user",
+		Groups:            []string{"engineering", "sre"},
+	})
+
+	p, srv := newTestKeycloakProvider(t, nil, nil)
+	defer srv.Close()
+
+	session := &sessions.SessionState{AccessToken: accessToken}
+	if err := p.EnrichSession(session); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if session.Email != "user@example.com" {
+		t.Errorf("expected email to be resolved from the access token, got %q", session.Email)
+	}
+	if len(session.Groups) != 2 || session.Groups[0] != "engineering" {
+		t.Errorf("expected groups from access token, got %v", session.Groups)
+	}
+	if session.Claims["preferred_username"] != "user" {
+		t.Errorf("expected preferred_username to be exposed via the generic Claims map, got %v", session.Claims)
+	}
+}
+
+func TestKeycloakProviderEnrichSessionFallsBackToUserInfo(t *testing.T) {
+	accessToken := encodeJWT(t, keycloakAccessTokenClaims{
+		Email:             "user@example.com",
+		PreferredUsername: "user",
+	})
+
+	p, srv := newTestKeycloakProvider(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(keycloakAccessTokenClaims{
+			Groups: []string{"realm-admins"},
+		})
+	})
+	defer srv.Close()
+
+	session := &sessions.SessionState{AccessToken: accessToken}
+	if err := p.EnrichSession(session); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(session.Groups) != 1 || session.Groups[0] != "realm-admins" {
+		t.Errorf("expected groups resolved from userinfo fallback, got %v", session.Groups)
+	}
+}
+
+func TestKeycloakProviderValidateGroup(t *testing.T) {
+	accessToken := encodeJWT(t, keycloakAccessTokenClaims{
+		Groups: []string{"engineering", "sre"},
+	})
+
+	p, srv := newTestKeycloakProvider(t, nil, nil)
+	defer srv.Close()
+
+	inGroups, allowed, err := p.ValidateGroup("user@example.com", []string{"sre", "data"}, accessToken)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !allowed {
+		t.Fatalf("expected user to be allowed via the sre group")
+	}
+	if len(inGroups) != 1 || inGroups[0] != "sre" {
+		t.Errorf("expected inGroups to contain only sre, got %v", inGroups)
+	}
+}
+
+func TestKeycloakProviderValidateGroupNoMatch(t *testing.T) {
+	accessToken := encodeJWT(t, keycloakAccessTokenClaims{
+		Groups: []string{"engineering"},
+	})
+
+	p, srv := newTestKeycloakProvider(t, nil, nil)
+	defer srv.Close()
+
+	inGroups, allowed, err := p.ValidateGroup("user@example.com", []string{"sre"}, accessToken)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if allowed {
+		t.Fatalf("expected user not to be allowed")
+	}
+	if len(inGroups) != 0 {
+		t.Errorf("expected no matching groups, got %v", inGroups)
+	}
+}
+
+func TestKeycloakProviderUserGroupsMissingClaim(t *testing.T) {
+	accessToken := encodeJWT(t, keycloakAccessTokenClaims{})
+
+	p, srv := newTestKeycloakProvider(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	defer srv.Close()
+
+	_, err := p.UserGroups("user@example.com", nil, accessToken)
+	if err == nil {
+		t.Fatalf("expected an error when userinfo is unavailable and the token has no groups claim")
+	}
+}
+
+func TestKeycloakProviderEnrichSessionZeroGroupsIsNotAnError(t *testing.T) {
+	accessToken := encodeJWT(t, keycloakAccessTokenClaims{
+		Email:             "user@example.com",
+		PreferredUsername: "user",
+	})
+
+	p, srv := newTestKeycloakProvider(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(keycloakAccessTokenClaims{})
+	})
+	defer srv.Close()
+
+	session := &sessions.SessionState{AccessToken: accessToken}
+	if err := p.EnrichSession(session); err != nil {
+		t.Fatalf("expected a user in zero groups to enrich successfully, got %v", err)
+	}
+	if len(session.Groups) != 0 {
+		t.Errorf("expected no groups, got %v", session.Groups)
+	}
+}
+
+func TestKeycloakProviderUserGroupsFromRealmAndClientRoles(t *testing.T) {
+	accessToken := encodeJWT(t, map[string]interface{}{
+		"realm_access":    map[string]interface{}{"roles": []string{"realm-admins"}},
+		"resource_access": map[string]interface{}{"sso-proxy": map[string]interface{}{"roles": []string{"sre"}}},
+	})
+
+	p, srv := newTestKeycloakProvider(t, nil, nil)
+	defer srv.Close()
+
+	groups, err := p.UserGroups("user@example.com", nil, accessToken)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(groups) != 2 {
+		t.Fatalf("expected realm and client roles to both be resolved as groups, got %v", groups)
+	}
+}
+
+func TestKeycloakProviderGroupsClaimConfigurable(t *testing.T) {
+	accessToken := encodeJWT(t, map[string]interface{}{
+		"roles": []string{"sre"},
+	})
+
+	p, srv := newTestKeycloakProvider(t, nil, nil)
+	p.GroupsClaim = "roles"
+	defer srv.Close()
+
+	groups, err := p.UserGroups("user@example.com", nil, accessToken)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(groups) != 1 || groups[0] != "sre" {
+		t.Errorf("expected groups resolved from the configured GroupsClaim, got %v", groups)
+	}
+}
+
+func TestKeycloakProviderValidateSessionTokenExpiry(t *testing.T) {
+	p, srv := newTestKeycloakProvider(t, nil, nil)
+	defer srv.Close()
+
+	expired := encodeJWT(t, keycloakAccessTokenClaims{ExpiresAt: time.Now().Add(-time.Hour).Unix()})
+	if p.ValidateSessionToken(&sessions.SessionState{AccessToken: expired}) {
+		t.Errorf("expected an expired access token to be invalid")
+	}
+
+	valid := encodeJWT(t, keycloakAccessTokenClaims{ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	if !p.ValidateSessionToken(&sessions.SessionState{AccessToken: valid}) {
+		t.Errorf("expected an unexpired access token to be valid")
+	}
+}
+
+func TestKeycloakProviderValidateSessionTokenIgnoresGroups(t *testing.T) {
+	accessToken := encodeJWT(t, keycloakAccessTokenClaims{ExpiresAt: time.Now().Add(time.Hour).Unix()})
+
+	// No UserInfoURL configured and no groups claim on the token -- group
+	// resolution would fail, but session validity must not depend on it.
+	p := NewKeycloakProvider(&ProviderData{ProviderName: "keycloak", ClientID: "sso-proxy"})
+	if !p.ValidateSessionToken(&sessions.SessionState{AccessToken: accessToken}) {
+		t.Errorf("expected a valid, unexpired token to validate even with zero resolvable groups")
+	}
+}
+
+func TestKeycloakProviderRefreshSessionToken(t *testing.T) {
+	p, srv := newTestKeycloakProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("grant_type") != "refresh_token" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(keycloakTokenResponse{
+			AccessToken:  "new-access-token",
+			RefreshToken: "new-refresh-token",
+			ExpiresIn:    3600,
+		})
+	}, nil)
+	defer srv.Close()
+
+	session := &sessions.SessionState{
+		AccessToken:  "old-access",
+		RefreshToken: "refresh-1",
+	}
+	refreshed, err := p.RefreshSessionToken(session)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !refreshed {
+		t.Fatalf("expected token to be refreshed")
+	}
+	if session.AccessToken != "new-access-token" {
+		t.Errorf("expected session to be updated with the new access token, got %q", session.AccessToken)
+	}
+}
+
+func TestKeycloakProviderRefreshSessionTokenNoRefreshToken(t *testing.T) {
+	p, srv := newTestKeycloakProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Fatalf("token endpoint should not be called without a refresh token")
+	}, nil)
+	defer srv.Close()
+
+	refreshed, err := p.RefreshSessionToken(&sessions.SessionState{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if refreshed {
+		t.Fatalf("expected refresh to be a no-op without a refresh token")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"net/url"
 	"sort"
 	"strings"
+	"sync"
 
 	"github.com/buzzfeed/sso/internal/pkg/sessions"
 	"github.com/buzzfeed/sso/internal/pkg/singleflight"
@@ -39,27 +40,91 @@ type SingleFlightProvider struct {
 	provider Provider
 
 	single *singleflight.Group
+
+	breakerCfg BreakerConfig
+	breakersMu sync.Mutex
+	breakers   map[string]*endpointBreaker
 }
 
-// NewSingleFlightProvider instatiates a SingleFlightProvider given a provider and statsdClient
-func NewSingleFlightProvider(provider Provider, StatsdClient *statsd.Client) *SingleFlightProvider {
+// NewSingleFlightProvider instatiates a SingleFlightProvider given a
+// provider, a statsdClient, and a BreakerConfig. Zero-valued fields in cfg
+// fall back to DefaultBreakerConfig's corresponding field, so callers can
+// override just the thresholds they care about.
+func NewSingleFlightProvider(provider Provider, StatsdClient *statsd.Client, cfg BreakerConfig) *SingleFlightProvider {
+	if cfg.WindowSize <= 0 {
+		cfg.WindowSize = DefaultBreakerConfig.WindowSize
+	}
+	if cfg.MinRequests <= 0 {
+		cfg.MinRequests = DefaultBreakerConfig.MinRequests
+	}
+	if cfg.ErrorThreshold <= 0 {
+		cfg.ErrorThreshold = DefaultBreakerConfig.ErrorThreshold
+	}
+	if cfg.MaxInFlight <= 0 {
+		cfg.MaxInFlight = DefaultBreakerConfig.MaxInFlight
+	}
+	if cfg.OpenDuration <= 0 {
+		cfg.OpenDuration = DefaultBreakerConfig.OpenDuration
+	}
+	if cfg.GracePeriod <= 0 {
+		cfg.GracePeriod = DefaultBreakerConfig.GracePeriod
+	}
+
 	return &SingleFlightProvider{
 		provider:     provider,
 		single:       &singleflight.Group{},
 		StatsdClient: StatsdClient,
+		breakerCfg:   cfg,
+		breakers:     make(map[string]*endpointBreaker),
 	}
 }
 
+// breakerFor returns the endpointBreaker for endpoint, creating it on first use.
+func (p *SingleFlightProvider) breakerFor(endpoint string) *endpointBreaker {
+	p.breakersMu.Lock()
+	defer p.breakersMu.Unlock()
+	b, ok := p.breakers[endpoint]
+	if !ok {
+		b = newEndpointBreaker(p.breakerCfg)
+		p.breakers[endpoint] = b
+	}
+	return b
+}
+
 func (p *SingleFlightProvider) do(endpoint, key string, fn func() (interface{}, error)) (interface{}, error) {
+	breaker := p.breakerFor(endpoint)
+
+	ok, probe := breaker.admit()
+	if !ok {
+		state, inFlight := breaker.snapshot()
+		p.emitBreakerMetrics(endpoint, state, inFlight)
+		return nil, &ErrProviderUnavailable{
+			Endpoint: endpoint,
+			Opened:   breaker.openedAtOrNow(),
+			Grace:    p.breakerCfg.GracePeriod,
+		}
+	}
+
 	compositeKey := fmt.Sprintf("%s/%s", endpoint, key)
 	resp, shared, err := p.single.Do(compositeKey, fn)
 	if shared > 0 {
 		tags := []string{fmt.Sprintf("endpoint:%s", endpoint)}
 		p.StatsdClient.Incr("provider.singleflight", tags, float64(shared))
 	}
+
+	breaker.release(probe, err == nil)
+	state, inFlight := breaker.snapshot()
+	p.emitBreakerMetrics(endpoint, state, inFlight)
+
 	return resp, err
 }
 
+func (p *SingleFlightProvider) emitBreakerMetrics(endpoint string, state, inFlight int) {
+	tags := []string{fmt.Sprintf("endpoint:%s", endpoint)}
+	p.StatsdClient.Gauge("provider.breaker.state", float64(state), tags, 1)
+	p.StatsdClient.Gauge("provider.breaker.inflight", float64(inFlight), tags, 1)
+}
+
 // Data calls the provider's Data function
 func (p *SingleFlightProvider) Data() *ProviderData {
 	return p.provider.Data()
@@ -70,6 +135,37 @@ func (p *SingleFlightProvider) Redeem(redirectURL, code string) (*sessions.Sessi
 	return p.provider.Redeem(redirectURL, code)
 }
 
+// EnrichSession calls the provider's EnrichSession function, coalescing
+// concurrent calls for the same access token the same way ValidateSessionToken
+// is coalesced. Unlike ValidateSessionToken, EnrichSession communicates its
+// result by mutating its argument rather than through a return value, so a
+// waiter coalesced onto another caller's in-flight request never has its own
+// *sessions.SessionState touched by the closure below -- it must instead copy
+// the enriched fields off the singleflight leader's session once do returns.
+func (p *SingleFlightProvider) EnrichSession(s *sessions.SessionState) error {
+	response, err := p.do("EnrichSession", s.AccessToken, func() (interface{}, error) {
+		if err := p.provider.EnrichSession(s); err != nil {
+			return nil, err
+		}
+		return s, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	leader, ok := response.(*sessions.SessionState)
+	if !ok {
+		return ErrUnexpectedReturnType
+	}
+	if leader != s {
+		s.Email = leader.Email
+		s.User = leader.User
+		s.Groups = leader.Groups
+		s.Claims = leader.Claims
+	}
+	return nil
+}
+
 // ValidateGroup takes an email, allowedGroups, and userGroups and passes it to the provider's ValidateGroup function and returns the response
 func (p *SingleFlightProvider) ValidateGroup(email string, allowedGroups []string, accessToken string) ([]string, bool, error) {
 	type Response struct {
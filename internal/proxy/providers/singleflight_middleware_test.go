@@ -0,0 +1,97 @@
+package providers
+
+import (
+	"sync"
+
+	"testing"
+	"time"
+
+	"github.com/buzzfeed/sso/internal/pkg/sessions"
+)
+
+// blockingEnrichProvider embeds Provider so it only needs to implement
+// EnrichSession for these tests. The first call closes start and then blocks
+// until release is closed, so a second call for the same access token made
+// in that window is coalesced onto the first.
+type blockingEnrichProvider struct {
+	Provider
+
+	start   chan struct{}
+	release chan struct{}
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (b *blockingEnrichProvider) EnrichSession(s *sessions.SessionState) error {
+	b.mu.Lock()
+	first := b.calls == 0
+	b.calls++
+	b.mu.Unlock()
+
+	if first {
+		close(b.start)
+		<-b.release
+	}
+
+	s.Email = "user@example.com"
+	s.User = "user"
+	s.Groups = []string{"sre"}
+	s.Claims = map[string]string{"preferred_username": "user"}
+	return nil
+}
+
+func TestSingleFlightProviderEnrichSessionCoalescesConcurrentCallers(t *testing.T) {
+	inner := &blockingEnrichProvider{start: make(chan struct{}), release: make(chan struct{})}
+	p := NewSingleFlightProvider(inner, newTestStatsdClient(t), BreakerConfig{})
+
+	leaderSession := &sessions.SessionState{AccessToken: "shared-token"}
+	waiterSession := &sessions.SessionState{AccessToken: "shared-token"}
+
+	var leaderErr error
+	done := make(chan struct{})
+	go func() {
+		leaderErr = p.EnrichSession(leaderSession)
+		close(done)
+	}()
+
+	<-inner.start
+
+	// Issue the waiter's call while the leader is still blocked, and give it
+	// time to join the leader's in-flight request before releasing it.
+	waiterErr := make(chan error, 1)
+	go func() {
+		waiterErr <- p.EnrichSession(waiterSession)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(inner.release)
+
+	if err := <-waiterErr; err != nil {
+		t.Fatalf("unexpected error from the coalesced waiter: %v", err)
+	}
+	<-done
+	if leaderErr != nil {
+		t.Fatalf("unexpected error from the leader: %v", leaderErr)
+	}
+
+	if waiterSession.Email != "user@example.com" || waiterSession.User != "user" || len(waiterSession.Groups) != 1 {
+		t.Errorf("expected the coalesced waiter's session to be enriched from the leader's result, got %+v", waiterSession)
+	}
+	if waiterSession.Claims["preferred_username"] != "user" {
+		t.Errorf("expected the coalesced waiter's Claims to be copied from the leader's result, got %+v", waiterSession.Claims)
+	}
+}
+
+func TestSingleFlightProviderEnrichSessionSequential(t *testing.T) {
+	inner := &blockingEnrichProvider{start: make(chan struct{}), release: make(chan struct{})}
+	close(inner.release)
+	p := NewSingleFlightProvider(inner, newTestStatsdClient(t), BreakerConfig{})
+
+	s := &sessions.SessionState{AccessToken: "token"}
+	if err := p.EnrichSession(s); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.Email != "user@example.com" {
+		t.Errorf("expected the session to be enriched, got %+v", s)
+	}
+}